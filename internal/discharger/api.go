@@ -9,7 +9,7 @@ import (
 	"context"
 
 	"github.com/juju/loggo"
-	"golang.org/x/net/trace"
+	oteltrace "go.opentelemetry.io/otel/trace"
 	"gopkg.in/CanonicalLtd/candidclient.v1/params"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/httprequest.v1"
@@ -27,7 +27,7 @@ var logger = loggo.GetLogger("candid.internal.discharger")
 // NewAPIHandler is an identity.NewAPIHandlerFunc.
 func NewAPIHandler(params identity.HandlerParams) ([]httprequest.Handler, error) {
 	reqAuth := httpauth.New(params.Oven, params.Authorizer)
-	place := &place{params.MeetingPlace}
+	place := &place{meetingPlace: params.MeetingPlace, tracer: tracer(params)}
 	dt := &dischargeTokenCreator{
 		params: params,
 	}
@@ -35,7 +35,7 @@ func NewAPIHandler(params identity.HandlerParams) ([]httprequest.Handler, error)
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
-	dts := internal.NewDischargeTokenStore(dtks)
+	dts := internal.NewDischargeTokenStore(dtks, tracer(params))
 	vc := &visitCompleter{
 		params:                params,
 		dischargeTokenCreator: dt,
@@ -83,6 +83,7 @@ func NewAPIHandler(params identity.HandlerParams) ([]httprequest.Handler, error)
 		})
 	}
 	handlers = append(handlers, idpHandlers(params)...)
+	handlers = append(handlers, oidcHandlers(params, dts)...)
 	return handlers, nil
 }
 
@@ -100,13 +101,13 @@ type handlerParams struct {
 // handlerCreator returns a function that creates new instances of the discharger API handler for a request.
 func handlerCreator(hParams handlerParams) func(p httprequest.Params, arg interface{}) (*handler, context.Context, error) {
 	return func(p httprequest.Params, arg interface{}) (*handler, context.Context, error) {
-		t := trace.New(p.Request.URL.Path, p.PathPattern)
-		ctx := trace.NewContext(p.Context, t)
+		ctx := extractTraceContext(p.Context, p.Request)
+		ctx, span := tracer(hParams.HandlerParams).Start(ctx, p.PathPattern)
 		ctx, close1 := hParams.Store.Context(ctx)
 		ctx, close2 := hParams.MeetingStore.Context(ctx)
 		hnd := &handler{
 			params: hParams,
-			trace:  t,
+			span:   span,
 			monReq: monitoring.NewRequest(&p),
 			close: func() {
 				close2()
@@ -115,6 +116,7 @@ func handlerCreator(hParams handlerParams) func(p httprequest.Params, arg interf
 		}
 		op := opForRequest(arg)
 		logger.Debugf("opForRequest %#v -> %#v", arg, op)
+		span.SetAttributes(entityAttribute.String(string(op.Entity)))
 		if op.Entity == "" {
 			hnd.Close()
 			return nil, nil, params.ErrUnauthorized
@@ -133,7 +135,7 @@ type handler struct {
 	params handlerParams
 
 	monReq monitoring.Request
-	trace  trace.Trace
+	span   oteltrace.Span
 	close  func()
 }
 
@@ -141,7 +143,7 @@ type handler struct {
 // once a request is complete.
 func (h *handler) Close() error {
 	h.close()
-	h.trace.Finish()
+	h.span.End()
 	h.monReq.ObserveMetric()
 	return nil
 }
@@ -0,0 +1,108 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
+
+	"github.com/CanonicalLtd/candid/store"
+)
+
+// A CaveatType is a pluggable, strongly-typed constraint that a
+// relying party may request be embedded into an identity macaroon or
+// discharge token issued by Candid. Plugins register a CaveatType
+// with RegisterCaveatType, typically from a package init function,
+// so that it can be named in the requested-constraints blob carried
+// by a third-party caveat's condition.
+type CaveatType struct {
+	// ID is the unique name of the constraint as it appears in
+	// the requested-constraints blob, e.g. "require-group".
+	ID string
+
+	// Decode unmarshals the raw constraint argument supplied by
+	// the caller into a value that is later passed to Check and
+	// Caveat.
+	Decode func(arg json.RawMessage) (interface{}, error)
+
+	// Check reports whether id currently satisfies the decoded
+	// constraint value. It returns a params.ErrForbidden error if
+	// not.
+	Check func(ctx context.Context, id *store.Identity, value interface{}) error
+
+	// Caveat returns the first-party caveat that should be baked
+	// into the issued macaroon so that later verification
+	// re-enforces the constraint.
+	Caveat func(value interface{}) checkers.Caveat
+}
+
+// caveatTypes holds the registered set of CaveatTypes, keyed by ID.
+var caveatTypes = make(map[string]CaveatType)
+
+// RegisterCaveatType registers ct so that it can be requested by
+// relying parties. It panics if a CaveatType with the same ID has
+// already been registered.
+func RegisterCaveatType(ct CaveatType) {
+	if _, ok := caveatTypes[ct.ID]; ok {
+		panic("discharger: caveat type " + ct.ID + " already registered")
+	}
+	caveatTypes[ct.ID] = ct
+}
+
+// requestedConstraint is a single entry in the requested-constraints
+// blob carried in a third-party caveat's condition.
+type requestedConstraint struct {
+	ID  string          `json:"id"`
+	Arg json.RawMessage `json:"arg"`
+}
+
+// requestedConstraintsPrefix marks a caveat condition as carrying a
+// requested-constraints blob rather than a plain condition.
+const requestedConstraintsPrefix = "candid-constraints "
+
+// parseRequestedConstraints extracts the requested constraints
+// encoded in a third-party caveat condition, if any. A condition
+// that does not carry a requested-constraints blob yields a nil,
+// nil result.
+func parseRequestedConstraints(condition []byte) ([]requestedConstraint, error) {
+	s := string(condition)
+	if !strings.HasPrefix(s, requestedConstraintsPrefix) {
+		return nil, nil
+	}
+	var reqs []requestedConstraint
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(s, requestedConstraintsPrefix)), &reqs); err != nil {
+		return nil, errgo.Notef(err, "cannot unmarshal requested constraints")
+	}
+	return reqs, nil
+}
+
+// caveatsForConstraints validates each of the requested constraints
+// against id and returns the first-party caveats that must be baked
+// into the issued macaroon to re-enforce them. It returns a
+// params.ErrForbidden error if id does not satisfy a requested
+// constraint, or a params.ErrBadRequest error if an unknown
+// constraint is requested.
+func caveatsForConstraints(ctx context.Context, reqs []requestedConstraint, id *store.Identity) ([]checkers.Caveat, error) {
+	caveats := make([]checkers.Caveat, 0, len(reqs))
+	for _, req := range reqs {
+		ct, ok := caveatTypes[req.ID]
+		if !ok {
+			return nil, errgo.WithCausef(nil, params.ErrBadRequest, "unknown constraint %q", req.ID)
+		}
+		value, err := ct.Decode(req.Arg)
+		if err != nil {
+			return nil, errgo.WithCausef(err, params.ErrBadRequest, "invalid argument for constraint %q", req.ID)
+		}
+		if err := ct.Check(ctx, id, value); err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+		caveats = append(caveats, ct.Caveat(value))
+	}
+	return caveats, nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
+
+	"github.com/CanonicalLtd/candid/store"
+)
+
+func init() {
+	RegisterCaveatType(CaveatType{
+		ID:     "discharge-expiry-lte",
+		Decode: decodeDurationArg,
+		Check: func(_ context.Context, _ *store.Identity, _ interface{}) error {
+			// Any duration is acceptable; it is clamped to
+			// identityMacaroonDuration by Caveat below.
+			return nil
+		},
+		Caveat: func(value interface{}) checkers.Caveat {
+			d := value.(time.Duration)
+			if d > identityMacaroonDuration {
+				d = identityMacaroonDuration
+			}
+			return checkers.TimeBeforeCaveat(time.Now().Add(d))
+		},
+	})
+
+	RegisterCaveatType(CaveatType{
+		ID:     "require-group",
+		Decode: decodeStringsArg,
+		Check: func(_ context.Context, id *store.Identity, value interface{}) error {
+			want := value.([]string)
+			for _, g := range want {
+				if isMember(id.Groups, g) {
+					return nil
+				}
+			}
+			return errgo.WithCausef(nil, params.ErrForbidden, "not a member of any of %v", want)
+		},
+		Caveat: func(value interface{}) checkers.Caveat {
+			return httpbakeryCaveat("require-group", strings.Join(value.([]string), " "))
+		},
+	})
+
+	RegisterCaveatType(CaveatType{
+		ID:     "require-idp-method",
+		Decode: decodeStringArg,
+		// Check reads the IDP name thirdPartyCaveatChecker recorded
+		// from the discharge token's amr claim, not a live IDP
+		// handling context - there isn't one at this point in the
+		// request.
+		Check: func(ctx context.Context, _ *store.Identity, value interface{}) error {
+			method := value.(string)
+			if idpNameFromContext(ctx) != method {
+				return errgo.WithCausef(nil, params.ErrForbidden, "login method %q required", method)
+			}
+			return nil
+		},
+		Caveat: func(value interface{}) checkers.Caveat {
+			return httpbakeryCaveat("require-idp-method", value.(string))
+		},
+	})
+
+	RegisterCaveatType(CaveatType{
+		ID:     "require-domain",
+		Decode: decodeStringArg,
+		Check: func(_ context.Context, id *store.Identity, value interface{}) error {
+			domain := value.(string)
+			if !strings.HasSuffix(id.Email, "@"+domain) && !strings.HasSuffix(id.Email, "."+domain) {
+				return errgo.WithCausef(nil, params.ErrForbidden, "email domain %q required", domain)
+			}
+			return nil
+		},
+		Caveat: func(value interface{}) checkers.Caveat {
+			return httpbakeryCaveat("require-domain", value.(string))
+		},
+	})
+}
+
+func decodeDurationArg(arg json.RawMessage) (interface{}, error) {
+	var s string
+	if err := json.Unmarshal(arg, &s); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return d, nil
+}
+
+func decodeStringArg(arg json.RawMessage) (interface{}, error) {
+	var s string
+	if err := json.Unmarshal(arg, &s); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return s, nil
+}
+
+func decodeStringsArg(arg json.RawMessage) (interface{}, error) {
+	var ss []string
+	if err := json.Unmarshal(arg, &ss); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return ss, nil
+}
+
+// httpbakeryCaveat builds a first-party caveat with the given
+// condition and argument, in the same "cond arg" form used throughout
+// the bakery checkers package.
+func httpbakeryCaveat(cond, arg string) checkers.Caveat {
+	return checkers.Caveat{Condition: cond + " " + arg}
+}
+
+func isMember(groups []string, group string) bool {
+	for _, g := range groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
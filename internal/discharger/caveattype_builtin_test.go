@@ -0,0 +1,162 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+
+	"github.com/CanonicalLtd/candid/store"
+)
+
+func mustArg(t *testing.T, v interface{}) json.RawMessage {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("cannot marshal argument: %v", err)
+	}
+	return data
+}
+
+func TestRequireGroupCaveatType(t *testing.T) {
+	ct := caveatTypes["require-group"]
+	value, err := ct.Decode(mustArg(t, []string{"admin", "ops"}))
+	if err != nil {
+		t.Fatalf("unexpected decode error: %v", err)
+	}
+	id := &store.Identity{Username: "bob", Groups: []string{"ops"}}
+	if err := ct.Check(context.Background(), id, value); err != nil {
+		t.Fatalf("expected member of ops to satisfy the constraint, got: %v", err)
+	}
+	id.Groups = []string{"dev"}
+	err = ct.Check(context.Background(), id, value)
+	if errgo.Cause(err) != params.ErrForbidden {
+		t.Fatalf("expected ErrForbidden, got: %v", err)
+	}
+}
+
+func TestRequireDomainCaveatType(t *testing.T) {
+	ct := caveatTypes["require-domain"]
+	value, err := ct.Decode(mustArg(t, "example.com"))
+	if err != nil {
+		t.Fatalf("unexpected decode error: %v", err)
+	}
+	id := &store.Identity{Username: "bob", Email: "bob@example.com"}
+	if err := ct.Check(context.Background(), id, value); err != nil {
+		t.Fatalf("expected matching domain to satisfy the constraint, got: %v", err)
+	}
+	id.Email = "bob@other.com"
+	err = ct.Check(context.Background(), id, value)
+	if errgo.Cause(err) != params.ErrForbidden {
+		t.Fatalf("expected ErrForbidden, got: %v", err)
+	}
+}
+
+func TestRequireIDPMethodCaveatType(t *testing.T) {
+	ct := caveatTypes["require-idp-method"]
+	value, err := ct.Decode(mustArg(t, "otp"))
+	if err != nil {
+		t.Fatalf("unexpected decode error: %v", err)
+	}
+	id := &store.Identity{Username: "bob"}
+
+	// With no IDP name recorded in the context at all (as would be
+	// the case if the checker never set one from the discharge
+	// token's amr claim), the constraint must not be satisfied.
+	err = ct.Check(context.Background(), id, value)
+	if errgo.Cause(err) != params.ErrForbidden {
+		t.Fatalf("expected ErrForbidden with no recorded IDP, got: %v", err)
+	}
+
+	ctx := withIDPName(context.Background(), "otp")
+	if err := ct.Check(ctx, id, value); err != nil {
+		t.Fatalf("expected matching IDP method to satisfy the constraint, got: %v", err)
+	}
+
+	ctx = withIDPName(context.Background(), "password")
+	err = ct.Check(ctx, id, value)
+	if errgo.Cause(err) != params.ErrForbidden {
+		t.Fatalf("expected ErrForbidden with mismatched IDP, got: %v", err)
+	}
+}
+
+func TestDischargeExpiryLTECaveatType(t *testing.T) {
+	ct := caveatTypes["discharge-expiry-lte"]
+	value, err := ct.Decode(mustArg(t, "1h"))
+	if err != nil {
+		t.Fatalf("unexpected decode error: %v", err)
+	}
+	if err := ct.Check(context.Background(), &store.Identity{}, value); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	cav := ct.Caveat(value)
+	if cav.Condition == "" {
+		t.Fatalf("expected a non-empty caveat condition")
+	}
+
+	// A requested duration longer than identityMacaroonDuration is
+	// clamped rather than honoured verbatim.
+	long, err := ct.Decode(mustArg(t, (identityMacaroonDuration + time.Hour).String()))
+	if err != nil {
+		t.Fatalf("unexpected decode error: %v", err)
+	}
+	clamped := ct.Caveat(long)
+	unclamped := ct.Caveat(value)
+	if clamped.Condition == unclamped.Condition {
+		t.Fatalf("expected the clamped caveat to differ from the 1h one")
+	}
+}
+
+func TestCaveatsForConstraintsUnknownID(t *testing.T) {
+	reqs := []requestedConstraint{{ID: "no-such-constraint"}}
+	_, err := caveatsForConstraints(context.Background(), reqs, &store.Identity{})
+	if errgo.Cause(err) != params.ErrBadRequest {
+		t.Fatalf("expected ErrBadRequest for an unknown constraint, got: %v", err)
+	}
+}
+
+func TestCaveatsForConstraintsForbidden(t *testing.T) {
+	reqs := []requestedConstraint{{ID: "require-group", Arg: mustArg(t, []string{"admin"})}}
+	id := &store.Identity{Username: "bob", Groups: []string{"dev"}}
+	_, err := caveatsForConstraints(context.Background(), reqs, id)
+	if errgo.Cause(err) != params.ErrForbidden {
+		t.Fatalf("expected ErrForbidden, got: %v", err)
+	}
+}
+
+func TestCaveatsForConstraintsOK(t *testing.T) {
+	reqs := []requestedConstraint{{ID: "require-group", Arg: mustArg(t, []string{"admin"})}}
+	id := &store.Identity{Username: "bob", Groups: []string{"admin"}}
+	caveats, err := caveatsForConstraints(context.Background(), reqs, id)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(caveats) != 1 {
+		t.Fatalf("expected one caveat, got %v", caveats)
+	}
+}
+
+func TestParseRequestedConstraints(t *testing.T) {
+	reqs, err := parseRequestedConstraints([]byte("some-other-condition"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if reqs != nil {
+		t.Fatalf("expected no requested constraints, got %v", reqs)
+	}
+
+	blob := requestedConstraintsPrefix + `[{"id":"require-group","arg":["admin"]}]`
+	reqs, err = parseRequestedConstraints([]byte(blob))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(reqs) != 1 || reqs[0].ID != "require-group" {
+		t.Fatalf("unexpected requested constraints: %+v", reqs)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger
+
+import (
+	"context"
+
+	"gopkg.in/CanonicalLtd/candidclient.v1/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+
+	"github.com/CanonicalLtd/candid/internal/auth/httpauth"
+	"github.com/CanonicalLtd/candid/internal/identity"
+	"github.com/CanonicalLtd/candid/store"
+)
+
+// thirdPartyCaveatChecker is a httpbakery.ThirdPartyCaveatChecker that
+// resolves the third-party caveats sent to the discharger, either by
+// issuing an identity macaroon directly to an already-logged-in user
+// or by bouncing the user through an identity provider.
+type thirdPartyCaveatChecker struct {
+	params  identity.HandlerParams
+	place   *place
+	reqAuth *httpauth.Authorizer
+}
+
+// CheckThirdPartyCaveat implements httpbakery.ThirdPartyCaveatChecker.
+func (c *thirdPartyCaveatChecker) CheckThirdPartyCaveat(ctx context.Context, p httpbakery.ThirdPartyCaveatCheckerParams) ([]checkers.Caveat, error) {
+	rc, stepUpRequired, stepUpSatisfied, err := checkStepUp(ctx, p)
+	if err != nil {
+		return nil, errgo.WithCausef(err, params.ErrBadRequest, "")
+	}
+	var id *store.Identity
+	if stepUpSatisfied {
+		id, err = c.identityForDischarge(ctx, p)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Any)
+		}
+	}
+	if id == nil {
+		// Either there is no identity to discharge for yet, or the
+		// cached discharge token does not satisfy a require-auth
+		// requirement (for example, it used the wrong IDP, or the
+		// login is too old). Either way the caller must complete a
+		// fresh interactive login before we can proceed.
+		return nil, c.needLogin(ctx, p)
+	}
+	if caveats, ok, err := delegateCaveats(ctx, c.params.DelegateChecker, string(p.Caveat), id, stepUpRequired, rc); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	} else if ok {
+		// The delegate has decided that this caveat should be
+		// discharged elsewhere (or subject to further conditions)
+		// rather than by us issuing an identity macaroon directly.
+		// The client will perform another DischargeAll round
+		// against the returned caveats.
+		return caveats, nil
+	}
+	caveats, err := c.caveatsForIdentity(ctx, p, id)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	if stepUpRequired {
+		caveats = append(caveats, rc.caveat())
+	}
+	return caveats, nil
+}
+
+// delegateCaveats consults dc, if non-nil, about whether the caveat
+// described by condition should be discharged elsewhere instead of by
+// issuing id an identity macaroon directly. It reports ok=true if dc
+// intervened, in which case the returned caveats (with a re-asserted
+// step-up requirement if stepUpRequired) are what the client must
+// satisfy next instead.
+func delegateCaveats(ctx context.Context, dc identity.DelegateChecker, condition string, id *store.Identity, stepUpRequired bool, rc requireAuthCondition) (caveats []checkers.Caveat, ok bool, err error) {
+	if dc == nil {
+		return nil, false, nil
+	}
+	caveats, err = dc.CheckDelegate(ctx, condition, id)
+	if err != nil {
+		return nil, false, errgo.Mask(err, errgo.Any)
+	}
+	if len(caveats) == 0 {
+		return nil, false, nil
+	}
+	if stepUpRequired {
+		caveats = append(caveats, rc.caveat())
+	}
+	return caveats, true, nil
+}
+
+// identityForDischarge returns the identity that is discharging the
+// caveat in p, or nil if there is none yet (for example because the
+// request did not include a valid discharge token).
+func (c *thirdPartyCaveatChecker) identityForDischarge(ctx context.Context, p httpbakery.ThirdPartyCaveatCheckerParams) (*store.Identity, error) {
+	if p.Token == nil {
+		return nil, nil
+	}
+	id, err := identityFromDischargeToken(ctx, c.params.Store, p.Token)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return id, nil
+}
+
+// caveatsForIdentity returns the first-party caveats that should be
+// baked into the discharge macaroon issued for id, including any
+// additional constraints the caller requested in the caveat's
+// condition.
+func (c *thirdPartyCaveatChecker) caveatsForIdentity(ctx context.Context, p httpbakery.ThirdPartyCaveatCheckerParams, id *store.Identity) ([]checkers.Caveat, error) {
+	caveats := []checkers.Caveat{
+		checkers.DeclaredCaveat("username", id.Username),
+	}
+	reqs, err := parseRequestedConstraints(p.Caveat)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if method := authContextFromDischargeToken(p.Token).Method; method != "" {
+		// Record the IDP that was actually used to authenticate
+		// so that the require-idp-method constraint type can
+		// check it; at this point in the request there is no
+		// live IDP handling context to read it from.
+		ctx = withIDPName(ctx, method)
+	}
+	extra, err := caveatsForConstraints(ctx, reqs, id)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return append(caveats, extra...), nil
+}
+
+// needLogin starts an interactive login by creating a new rendezvous
+// in the meeting place and returning a httpbakery interaction-required
+// error that points the client at it.
+func (c *thirdPartyCaveatChecker) needLogin(ctx context.Context, p httpbakery.ThirdPartyCaveatCheckerParams) error {
+	dischargeID, err := c.place.NewRendezvous(ctx, "")
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return newInteractionRequiredError(c.params.Location, dischargeID, p)
+}
+
+// identityFromDischargeToken resolves the identity referred to by a
+// discharge token, looking it up in store so that callers observe
+// up-to-date identity details (group membership, login method, etc).
+func identityFromDischargeToken(ctx context.Context, s store.Store, dt *httpbakery.DischargeToken) (*store.Identity, error) {
+	username := usernameFromDischargeToken(dt)
+	if username == "" {
+		return nil, nil
+	}
+	id := &store.Identity{Username: username}
+	if err := s.Identity(ctx, id); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return id, nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger
+
+import (
+	"context"
+	"testing"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
+
+	"github.com/CanonicalLtd/candid/store"
+)
+
+// fakeDelegateChecker is a minimal identity.DelegateChecker used to
+// exercise delegateCaveats without needing a real discharger.
+type fakeDelegateChecker struct {
+	caveats []checkers.Caveat
+	err     error
+}
+
+func (f *fakeDelegateChecker) CheckDelegate(ctx context.Context, condition string, id *store.Identity) ([]checkers.Caveat, error) {
+	return f.caveats, f.err
+}
+
+func TestDelegateCaveatsNoDelegateChecker(t *testing.T) {
+	caveats, ok, err := delegateCaveats(context.Background(), nil, "cond", &store.Identity{Username: "bob"}, false, requireAuthCondition{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ok {
+		t.Fatalf("expected ok=false with no DelegateChecker")
+	}
+	if caveats != nil {
+		t.Fatalf("expected no caveats, got %v", caveats)
+	}
+}
+
+func TestDelegateCaveatsNoIntervention(t *testing.T) {
+	dc := &fakeDelegateChecker{}
+	caveats, ok, err := delegateCaveats(context.Background(), dc, "cond", &store.Identity{Username: "bob"}, true, requireAuthCondition{Method: "otp"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ok {
+		t.Fatalf("expected ok=false when the delegate returns no caveats")
+	}
+	if caveats != nil {
+		t.Fatalf("expected no caveats, got %v", caveats)
+	}
+}
+
+func TestDelegateCaveatsError(t *testing.T) {
+	dc := &fakeDelegateChecker{err: errgo.New("boom")}
+	_, _, err := delegateCaveats(context.Background(), dc, "cond", &store.Identity{Username: "bob"}, false, requireAuthCondition{})
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+}
+
+func TestDelegateCaveatsInterveneReassertsStepUp(t *testing.T) {
+	want := checkers.Caveat{Condition: "is-member-of admin"}
+	dc := &fakeDelegateChecker{caveats: []checkers.Caveat{want}}
+	rc := requireAuthCondition{Method: "otp"}
+	caveats, ok, err := delegateCaveats(context.Background(), dc, "cond", &store.Identity{Username: "bob"}, true, rc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !ok {
+		t.Fatalf("expected ok=true when the delegate intervenes")
+	}
+	if len(caveats) != 2 {
+		t.Fatalf("expected the delegate's caveat plus a re-asserted step-up caveat, got %v", caveats)
+	}
+	if caveats[0] != want {
+		t.Fatalf("expected the delegate's caveat first, got %v", caveats[0])
+	}
+	if caveats[1] != rc.caveat() {
+		t.Fatalf("expected a re-asserted require-auth caveat, got %v", caveats[1])
+	}
+}
+
+func TestDelegateCaveatsInterveneNoStepUp(t *testing.T) {
+	want := checkers.Caveat{Condition: "is-member-of admin"}
+	dc := &fakeDelegateChecker{caveats: []checkers.Caveat{want}}
+	caveats, ok, err := delegateCaveats(context.Background(), dc, "cond", &store.Identity{Username: "bob"}, false, requireAuthCondition{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !ok {
+		t.Fatalf("expected ok=true when the delegate intervenes")
+	}
+	if len(caveats) != 1 || caveats[0] != want {
+		t.Fatalf("expected only the delegate's caveat, got %v", caveats)
+	}
+}
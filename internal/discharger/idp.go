@@ -12,7 +12,7 @@ import (
 	"time"
 
 	"github.com/julienschmidt/httprouter"
-	"golang.org/x/net/trace"
+	oteltrace "go.opentelemetry.io/otel/trace"
 	candidclient "gopkg.in/CanonicalLtd/candidclient.v1"
 	"gopkg.in/CanonicalLtd/candidclient.v1/params"
 	"gopkg.in/errgo.v1"
@@ -72,9 +72,13 @@ func initIDPs(ctx context.Context, params initIDPParams) error {
 
 func newIDPHandler(params identity.HandlerParams, idp idp.IdentityProvider) httprouter.Handle {
 	return func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
-		t := trace.New("identity.internal.v1.idp", idp.Name())
-		defer t.Finish()
-		ctx := trace.NewContext(context.Background(), t)
+		ctx := extractTraceContext(context.Background(), req)
+		ctx, span := tracer(params).Start(ctx, "idp.Handle", oteltrace.WithAttributes(idpAttribute.String(idp.Name())))
+		defer span.End()
+		if waitID := req.URL.Query().Get("waitid"); waitID != "" {
+			span.SetAttributes(dischargeIDAttribute.String(waitID))
+		}
+		ctx = withIDPName(ctx, idp.Name())
 		ctx, close := params.Store.Context(ctx)
 		defer close()
 		ctx, close = params.MeetingStore.Context(ctx)
@@ -85,18 +89,48 @@ func newIDPHandler(params identity.HandlerParams, idp idp.IdentityProvider) http
 	}
 }
 
+// idpNameContextKey is the context key under which the name of the
+// identity provider handling the current request is stored.
+type idpNameContextKey struct{}
+
+// withIDPName returns a copy of ctx that records name as the identity
+// provider that authenticated the current request, so that later code
+// (such as the require-idp-method caveat type and
+// dischargeTokenCreator) can record or check which IDP was used. It is
+// set both while an IDP is actively handling a /login request, and
+// again by thirdPartyCaveatChecker from a discharge token's declared
+// amr claim when there is no live IDP handling context to read it
+// from.
+func withIDPName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, idpNameContextKey{}, name)
+}
+
+// idpNameFromContext returns the name of the identity provider that
+// authenticated the current request, or "" if none is recorded.
+func idpNameFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(idpNameContextKey{}).(string)
+	return name
+}
+
 type dischargeTokenCreator struct {
 	params identity.HandlerParams
 }
 
-func (d *dischargeTokenCreator) DischargeToken(ctx context.Context, id *store.Identity) (*httpbakery.DischargeToken, error) {
+func (d *dischargeTokenCreator) DischargeToken(ctx context.Context, id *store.Identity, extraCaveats ...checkers.Caveat) (*httpbakery.DischargeToken, error) {
+	ctx, span := tracer(d.params).Start(ctx, "dischargeTokenCreator.DischargeToken")
+	defer span.End()
+	caveats := append([]checkers.Caveat{
+		checkers.TimeBeforeCaveat(time.Now().Add(dischargeTokenDuration)),
+		candidclient.UserDeclaration(id.Username),
+		checkers.DeclaredCaveat(authTimeDeclaredKey, formatAuthTime(time.Now())),
+	}, extraCaveats...)
+	if method := idpNameFromContext(ctx); method != "" {
+		caveats = append(caveats, checkers.DeclaredCaveat(amrDeclaredKey, method))
+	}
 	m, err := d.params.Oven.NewMacaroon(
 		ctx,
 		bakery.LatestVersion,
-		[]checkers.Caveat{
-			checkers.TimeBeforeCaveat(time.Now().Add(dischargeTokenDuration)),
-			candidclient.UserDeclaration(id.Username),
-		},
+		caveats,
 		identchecker.LoginOp,
 	)
 	if err != nil {
@@ -181,7 +215,7 @@ func (c *visitCompleter) RedirectSuccess(ctx context.Context, w http.ResponseWri
 		c.RedirectFailure(ctx, w, req, returnTo, state, errgo.Mask(err))
 		return
 	}
-	code, err := c.dischargeTokenStore.Put(ctx, dt, time.Now().Add(10*time.Minute))
+	code, err := c.dischargeTokenStore.Put(ctx, dt, time.Now().Add(10*time.Minute), codeExtraFromRequest(req))
 	if err != nil {
 		c.RedirectFailure(ctx, w, req, returnTo, state, errgo.Mask(err))
 		return
@@ -198,6 +232,21 @@ func (c *visitCompleter) RedirectSuccess(ctx context.Context, w http.ResponseWri
 	return
 }
 
+// codeExtraFromRequest extracts the OAuth2/OIDC authorize parameters
+// (client_id, redirect_uri and the PKCE challenge, if any) from the
+// request that completed the login, so that they can be bound to the
+// issued code and checked again when it is exchanged at the token
+// endpoint.
+func codeExtraFromRequest(req *http.Request) internal.CodeExtra {
+	req.ParseForm()
+	return internal.CodeExtra{
+		ClientID:            req.Form.Get("client_id"),
+		RedirectURI:         req.Form.Get("redirect_uri"),
+		CodeChallenge:       req.Form.Get("code_challenge"),
+		CodeChallengeMethod: req.Form.Get("code_challenge_method"),
+	}
+}
+
 // RedirectFailure implements idp.VisitCompleter.RedirectFailure.
 func (c *visitCompleter) RedirectFailure(ctx context.Context, w http.ResponseWriter, req *http.Request, returnTo, state string, err error) {
 	v := url.Values{
@@ -221,11 +270,44 @@ func (c *visitCompleter) RedirectFailure(ctx context.Context, w http.ResponseWri
 // not be possible to redirect to it.
 func (c *visitCompleter) redirect(w http.ResponseWriter, req *http.Request, returnTo string, query url.Values) error {
 	u, err := url.Parse(returnTo)
+	if err != nil {
+		return errgo.WithCausef(err, params.ErrBadRequest, "invalid return_to")
+	}
+	if c.params.RelyingPartyStore != nil {
+		// An OIDC relying party registry is configured; allow a
+		// redirect to one of the redirect URIs registered by the
+		// relying party that is actually logging in (identified by
+		// the authorize request's client_id), in addition to
+		// ourselves.
+		if strings.HasPrefix(returnTo, c.params.Location) || c.isRegisteredRedirectURI(req, returnTo) {
+			return c.doRedirect(w, req, u, query)
+		}
+		return errgo.WithCausef(nil, params.ErrBadRequest, "invalid return_to")
+	}
 	// We only support logins from ourselves for now, so only allow a
 	// redirect if it returns back to ourselves.
-	if !strings.HasPrefix(returnTo, c.params.Location) || err != nil {
-		return errgo.WithCausef(err, params.ErrBadRequest, "invalid return_to")
+	if !strings.HasPrefix(returnTo, c.params.Location) {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "invalid return_to")
 	}
+	return c.doRedirect(w, req, u, query)
+}
+
+// isRegisteredRedirectURI reports whether returnTo is one of the
+// redirect URIs registered by the relying party named by req's
+// client_id. It is not enough for returnTo to be registered to some
+// relying party; it must belong to the one that is actually logging
+// in, or one relying party could redirect through a URI stolen from
+// another's registration.
+func (c *visitCompleter) isRegisteredRedirectURI(req *http.Request, returnTo string) bool {
+	req.ParseForm()
+	rp, err := c.params.RelyingPartyStore.RelyingParty(req.Context(), req.Form.Get("client_id"))
+	if err != nil {
+		return false
+	}
+	return redirectURIAllowed(rp, returnTo)
+}
+
+func (c *visitCompleter) doRedirect(w http.ResponseWriter, req *http.Request, u *url.URL, query url.Values) error {
 	q := u.Query()
 	for k, v := range query {
 		q[k] = append(q[k], v...)
@@ -0,0 +1,20 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger
+
+import (
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+)
+
+// newInteractionRequiredError returns an error that tells the client
+// it must complete an interactive login, identified by dischargeID,
+// before the caveat in p can be discharged.
+func newInteractionRequiredError(location, dischargeID string, p httpbakery.ThirdPartyCaveatCheckerParams) error {
+	err := httpbakery.NewInteractionRequiredError(p.Req, nil)
+	httpbakery.WebBrowserInteractionInfo{
+		VisitURL: location + "/login?waitid=" + dischargeID,
+		WaitURL:  location + "/wait?waitid=" + dischargeID,
+	}.SetInteraction(err, "browser-window")
+	return err
+}
@@ -0,0 +1,105 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// Package internal holds types shared within the discharger package
+// that should not be exposed more widely.
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+
+	"github.com/CanonicalLtd/candid/store"
+)
+
+// A DischargeTokenStore stores discharge tokens against a short-lived
+// code so that they can later be exchanged by a client that cannot
+// itself hold a macaroon, such as the authorization-code leg of the
+// OAuth2/OIDC flow.
+type DischargeTokenStore struct {
+	kvStore store.KeyValueStore
+	tracer  oteltrace.Tracer
+}
+
+// NewDischargeTokenStore returns a new DischargeTokenStore that
+// stores its codes in kvStore, using tracer to trace its operations.
+func NewDischargeTokenStore(kvStore store.KeyValueStore, tracer oteltrace.Tracer) *DischargeTokenStore {
+	return &DischargeTokenStore{
+		kvStore: kvStore,
+		tracer:  tracer,
+	}
+}
+
+// CodeExtra holds additional information about the request that
+// caused a code to be issued, so that it can be validated again when
+// the code is exchanged. It is mostly used by the OAuth2/OIDC
+// token endpoint to tie a code to the client and PKCE challenge that
+// requested it.
+type CodeExtra struct {
+	// ClientID is the OAuth2 client that requested the code, or ""
+	// if the code was not issued as part of an OAuth2 flow.
+	ClientID string
+
+	// RedirectURI is the redirect_uri that was used to obtain the
+	// code, and that must be presented again at the token
+	// endpoint.
+	RedirectURI string
+
+	// CodeChallenge and CodeChallengeMethod hold the PKCE
+	// challenge, if any, that was presented when the code was
+	// requested.
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+// dischargeTokenEntry is the value stored against a code.
+type dischargeTokenEntry struct {
+	DischargeToken *httpbakery.DischargeToken
+	Extra          CodeExtra
+}
+
+// Put stores dt against a newly generated code that expires at
+// expire, returning the code. extra is stored alongside dt so that
+// it can be validated again when the code is exchanged.
+func (s *DischargeTokenStore) Put(ctx context.Context, dt *httpbakery.DischargeToken, expire time.Time, extra CodeExtra) (string, error) {
+	ctx, span := s.tracer.Start(ctx, "DischargeTokenStore.Put")
+	defer span.End()
+	code, err := randomString()
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	data, err := json.Marshal(dischargeTokenEntry{DischargeToken: dt, Extra: extra})
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	if err := s.kvStore.Set(ctx, code, string(data), expire); err != nil {
+		return "", errgo.Mask(err)
+	}
+	return code, nil
+}
+
+// Get retrieves the discharge token and extra information previously
+// stored against code. The code may only be used once; subsequent
+// calls with the same code will fail.
+func (s *DischargeTokenStore) Get(ctx context.Context, code string) (*httpbakery.DischargeToken, CodeExtra, error) {
+	ctx, span := s.tracer.Start(ctx, "DischargeTokenStore.Get")
+	defer span.End()
+	data, err := s.kvStore.Get(ctx, code)
+	if err != nil {
+		return nil, CodeExtra{}, errgo.Mask(err)
+	}
+	if err := s.kvStore.Remove(ctx, code); err != nil {
+		logger.Infof("cannot remove used discharge token code: %s", err)
+		return nil, CodeExtra{}, errgo.Notef(err, "cannot remove used discharge token code")
+	}
+	var entry dischargeTokenEntry
+	if err := json.Unmarshal([]byte(data), &entry); err != nil {
+		return nil, CodeExtra{}, errgo.Notef(err, "cannot unmarshal discharge token")
+	}
+	return entry.DischargeToken, entry.Extra, nil
+}
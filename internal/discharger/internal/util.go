@@ -0,0 +1,24 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+
+	"github.com/juju/loggo"
+	"gopkg.in/errgo.v1"
+)
+
+var logger = loggo.GetLogger("candid.internal.discharger.internal")
+
+// randomString returns a new random, URL-safe string suitable for use
+// as a one-time code.
+func randomString() (string, error) {
+	var b [18]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", errgo.Mask(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b[:]), nil
+}
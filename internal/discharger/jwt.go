@@ -0,0 +1,71 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// jwtHeader is the (fixed) JOSE header used for ID tokens issued by
+// the OIDC provider endpoints.
+var jwtHeader = map[string]string{"alg": "EdDSA", "typ": "JWT"}
+
+// signJWT encodes claims as a compact JWS, signed with key using
+// EdDSA. It only supports the subset of JWT needed by the OIDC
+// provider endpoints; it is not a general purpose JWT library.
+func signJWT(key ed25519.PrivateKey, claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(jwtHeader)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	signingInput := base64URLEncode(header) + "." + base64URLEncode(payload)
+	sig := ed25519.Sign(key, []byte(signingInput))
+	return signingInput + "." + base64URLEncode(sig), nil
+}
+
+// verifyJWT checks the signature of token against key and returns its
+// claims.
+func verifyJWT(key ed25519.PublicKey, token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errgo.New("malformed token")
+	}
+	sig, err := base64URLDecode(parts[2])
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if !ed25519.Verify(key, []byte(parts[0]+"."+parts[1]), sig) {
+		return nil, errgo.New("invalid signature")
+	}
+	payload, err := base64URLDecode(parts[1])
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return claims, nil
+}
+
+func base64URLEncode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func base64URLDecode(s string) ([]byte, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return b, nil
+}
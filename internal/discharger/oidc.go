@@ -0,0 +1,296 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+
+	"github.com/CanonicalLtd/candid/internal/discharger/internal"
+	"github.com/CanonicalLtd/candid/internal/identity"
+	"github.com/CanonicalLtd/candid/store"
+)
+
+// idTokenDuration is the length of time for which an issued ID token
+// is valid.
+const idTokenDuration = 10 * time.Minute
+
+// oidcHandler implements the OIDC provider endpoints that are layered
+// on top of the existing visitCompleter authorization-code handoff.
+type oidcHandler struct {
+	params              identity.HandlerParams
+	dischargeTokenStore *internal.DischargeTokenStore
+}
+
+// oidcHandlers returns the handlers for the OIDC provider endpoints.
+// It returns no handlers if params.RelyingPartyStore is nil, so that
+// deployments that do not want the OIDC surface need not configure
+// it.
+func oidcHandlers(params identity.HandlerParams, dts *internal.DischargeTokenStore) []httprequest.Handler {
+	if params.RelyingPartyStore == nil {
+		return nil
+	}
+	h := &oidcHandler{
+		params:              params,
+		dischargeTokenStore: dts,
+	}
+	return []httprequest.Handler{{
+		Method: "GET",
+		Path:   "/.well-known/openid-configuration",
+		Handle: h.serveConfiguration,
+	}, {
+		Method: "GET",
+		Path:   "/.well-known/jwks.json",
+		Handle: h.serveJWKS,
+	}, {
+		Method: "POST",
+		Path:   "/oauth2/token",
+		Handle: h.serveToken,
+	}, {
+		Method: "GET",
+		Path:   "/oauth2/userinfo",
+		Handle: h.serveUserinfo,
+	}}
+}
+
+// serveConfiguration implements the /.well-known/openid-configuration
+// discovery document.
+func (h *oidcHandler) serveConfiguration(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	loc := h.params.Location
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                loc,
+		"authorization_endpoint":                loc + "/login",
+		"token_endpoint":                        loc + "/oauth2/token",
+		"userinfo_endpoint":                     loc + "/oauth2/userinfo",
+		"jwks_uri":                              loc + "/.well-known/jwks.json",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"EdDSA"},
+		"scopes_supported":                      []string{"openid", "profile", "email"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+// serveJWKS implements the /.well-known/jwks.json endpoint, publishing
+// the public key used to verify issued ID tokens.
+func (h *oidcHandler) serveJWKS(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	pub := h.params.OIDCSigningKey.Public().(ed25519.PublicKey)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]interface{}{{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"use": "sig",
+			"kid": "1",
+			"x":   base64.RawURLEncoding.EncodeToString(pub),
+		}},
+	})
+}
+
+// serveToken implements the /oauth2/token endpoint, exchanging an
+// authorization code (as issued by visitCompleter.RedirectSuccess) for
+// a signed ID token.
+func (h *oidcHandler) serveToken(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ctx := extractTraceContext(req.Context(), req)
+	ctx, span := tracer(h.params).Start(ctx, "oidc.Token")
+	defer span.End()
+	if err := req.ParseForm(); err != nil {
+		writeTokenError(w, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	if req.Form.Get("grant_type") != "authorization_code" {
+		writeTokenError(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+	rp, err := h.params.RelyingPartyStore.RelyingParty(ctx, req.Form.Get("client_id"))
+	if err != nil {
+		writeTokenError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+	if !authenticateRelyingParty(rp, req.Form.Get("client_secret")) {
+		writeTokenError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+	dt, extra, err := h.dischargeTokenStore.Get(ctx, req.Form.Get("code"))
+	if err != nil {
+		writeTokenError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+	if extra.ClientID != rp.ClientID ||
+		extra.RedirectURI != req.Form.Get("redirect_uri") ||
+		!redirectURIAllowed(rp, extra.RedirectURI) {
+		writeTokenError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+	if len(rp.ClientSecretHash) == 0 && extra.CodeChallenge == "" {
+		// A public client (no client secret) must have used PKCE,
+		// or the code could be redeemed by anyone who intercepted
+		// it in transit.
+		writeTokenError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+	if extra.CodeChallenge != "" && !verifyPKCE(extra, req.Form.Get("code_verifier")) {
+		writeTokenError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+	scope, err := requestedScope(rp, req.Form.Get("scope"))
+	if err != nil {
+		writeTokenError(w, http.StatusBadRequest, "invalid_scope")
+		return
+	}
+	id := &store.Identity{Username: usernameFromDischargeToken(dt)}
+	if err := h.params.Store.Identity(ctx, id); err != nil {
+		writeTokenError(w, http.StatusInternalServerError, "server_error")
+		return
+	}
+	idToken, err := h.signIDToken(id, rp.ClientID)
+	if err != nil {
+		logger.Errorf("cannot sign id token: %s", err)
+		writeTokenError(w, http.StatusInternalServerError, "server_error")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": idToken,
+		"token_type":   "Bearer",
+		"id_token":     idToken,
+		"expires_in":   int(idTokenDuration.Seconds()),
+		"scope":        scope,
+	})
+}
+
+// serveUserinfo implements the /oauth2/userinfo endpoint, returning
+// claims about the identity named by the bearer token's subject.
+func (h *oidcHandler) serveUserinfo(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ctx := extractTraceContext(req.Context(), req)
+	ctx, span := tracer(h.params).Start(ctx, "oidc.Userinfo")
+	defer span.End()
+	username, err := h.verifyBearerToken(req.Header.Get("Authorization"))
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "invalid_token", http.StatusUnauthorized)
+		return
+	}
+	id := &store.Identity{Username: username}
+	if err := h.params.Store.Identity(ctx, id); err != nil {
+		identity.WriteError(ctx, w, errgo.Mask(err, errgo.Any))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"sub":   id.Username,
+		"name":  id.Name,
+		"email": id.Email,
+	})
+}
+
+func authenticateRelyingParty(rp *identity.RelyingParty, secret string) bool {
+	if len(rp.ClientSecretHash) == 0 {
+		// PKCE-only relying parties do not present a secret.
+		return true
+	}
+	return bcrypt.CompareHashAndPassword(rp.ClientSecretHash, []byte(secret)) == nil
+}
+
+// hashSecret returns the bcrypt hash of secret, suitable for storing
+// in RelyingParty.ClientSecretHash when registering a confidential
+// relying party.
+func hashSecret(secret string) []byte {
+	h, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		// Only fails if secret is absurdly long; there is nothing
+		// sensible to return to the caller in that case.
+		panic(err)
+	}
+	return h
+}
+
+// redirectURIAllowed reports whether redirectURI is one of rp's
+// registered redirect URIs.
+func redirectURIAllowed(rp *identity.RelyingParty, redirectURI string) bool {
+	return isMember(rp.RedirectURIs, redirectURI)
+}
+
+// requestedScope validates the space-separated scopes requested in
+// scope against the set rp is allowed to request, returning the scope
+// to grant. An empty scope grants all of rp's allowed scopes, as is
+// conventional for OAuth2 servers.
+func requestedScope(rp *identity.RelyingParty, scope string) (string, error) {
+	if scope == "" {
+		return strings.Join(rp.Scopes, " "), nil
+	}
+	for _, s := range strings.Fields(scope) {
+		if !isMember(rp.Scopes, s) {
+			return "", errgo.Newf("scope %q not allowed", s)
+		}
+	}
+	return scope, nil
+}
+
+func verifyPKCE(extra internal.CodeExtra, verifier string) bool {
+	if extra.CodeChallengeMethod != "S256" || verifier == "" {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:]) == extra.CodeChallenge
+}
+
+func writeTokenError(w http.ResponseWriter, status int, code string) {
+	writeJSON(w, status, map[string]interface{}{"error": code})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Errorf("cannot write JSON response: %s", err)
+	}
+}
+
+// signIDToken builds and signs a minimal OIDC ID token for id,
+// addressed to audience.
+func (h *oidcHandler) signIDToken(id *store.Identity, audience string) (string, error) {
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":   h.params.Location,
+		"sub":   id.Username,
+		"aud":   audience,
+		"iat":   now.Unix(),
+		"exp":   now.Add(idTokenDuration).Unix(),
+		"name":  id.Name,
+		"email": id.Email,
+	}
+	return signJWT(h.params.OIDCSigningKey, claims)
+}
+
+// verifyBearerToken checks the Authorization header for a valid
+// "Bearer <token>" ID token and returns the username it was issued
+// for.
+func (h *oidcHandler) verifyBearerToken(authorization string) (string, error) {
+	const prefix = "Bearer "
+	if len(authorization) <= len(prefix) || authorization[:len(prefix)] != prefix {
+		return "", errgo.New("no bearer token")
+	}
+	claims, err := verifyJWT(h.params.OIDCSigningKey.Public().(ed25519.PublicKey), authorization[len(prefix):])
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return "", errgo.New("token has no subject")
+	}
+	exp, _ := claims["exp"].(float64)
+	if time.Now().Unix() > int64(exp) {
+		return "", errgo.New("token has expired")
+	}
+	return sub, nil
+}
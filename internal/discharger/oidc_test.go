@@ -0,0 +1,91 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"testing"
+
+	"github.com/CanonicalLtd/candid/internal/discharger/internal"
+	"github.com/CanonicalLtd/candid/internal/identity"
+)
+
+func TestVerifyPKCE(t *testing.T) {
+	verifier := "some-code-verifier-value"
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	extra := internal.CodeExtra{CodeChallengeMethod: "S256", CodeChallenge: challenge}
+	if !verifyPKCE(extra, verifier) {
+		t.Fatalf("expected the correct verifier to satisfy the challenge")
+	}
+	if verifyPKCE(extra, "wrong-verifier") {
+		t.Fatalf("expected an incorrect verifier to fail")
+	}
+	if verifyPKCE(extra, "") {
+		t.Fatalf("expected an empty verifier to fail")
+	}
+
+	plainExtra := internal.CodeExtra{CodeChallengeMethod: "plain", CodeChallenge: verifier}
+	if verifyPKCE(plainExtra, verifier) {
+		t.Fatalf("expected an unsupported challenge method to fail")
+	}
+}
+
+func TestAuthenticateRelyingPartyNoSecret(t *testing.T) {
+	// A PKCE-only relying party has no client secret hash and
+	// authenticates regardless of what is presented.
+	rp := &identity.RelyingParty{ClientID: "rp1"}
+	if !authenticateRelyingParty(rp, "") {
+		t.Fatalf("expected a PKCE-only relying party to authenticate without a secret")
+	}
+}
+
+func TestAuthenticateRelyingPartyWithSecret(t *testing.T) {
+	rp := &identity.RelyingParty{ClientID: "rp1", ClientSecretHash: hashSecret("s3kret")}
+	if !authenticateRelyingParty(rp, "s3kret") {
+		t.Fatalf("expected the correct secret to authenticate")
+	}
+	if authenticateRelyingParty(rp, "wrong") {
+		t.Fatalf("expected an incorrect secret to fail authentication")
+	}
+}
+
+func TestRedirectURIAllowed(t *testing.T) {
+	rp := &identity.RelyingParty{
+		ClientID:     "rp1",
+		RedirectURIs: []string{"https://rp1.example/callback"},
+	}
+	if !redirectURIAllowed(rp, "https://rp1.example/callback") {
+		t.Fatalf("expected the registered redirect URI to be allowed")
+	}
+	if redirectURIAllowed(rp, "https://rp2.example/callback") {
+		t.Fatalf("expected a redirect URI registered to a different relying party to be rejected")
+	}
+}
+
+func TestRequestedScope(t *testing.T) {
+	rp := &identity.RelyingParty{ClientID: "rp1", Scopes: []string{"openid", "profile"}}
+
+	got, err := requestedScope(rp, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != "openid profile" {
+		t.Fatalf("expected the default scope to be all of rp's allowed scopes, got %q", got)
+	}
+
+	got, err = requestedScope(rp, "openid")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != "openid" {
+		t.Fatalf("expected the requested scope to be granted, got %q", got)
+	}
+
+	if _, err := requestedScope(rp, "openid admin"); err == nil {
+		t.Fatalf("expected a scope outside rp's allowed set to be rejected")
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger
+
+import (
+	"context"
+
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+
+	"github.com/CanonicalLtd/candid/meeting"
+)
+
+// loginInfo is the data passed through the meeting place to convey
+// the result of an interactive login back to the request that is
+// waiting for a discharge.
+type loginInfo struct {
+	DischargeToken *httpbakery.DischargeToken
+	Error          *httpbakery.Error
+}
+
+// place wraps a meeting.Place, providing a rendezvous mechanism that
+// ties together a request waiting for a discharge and the browser
+// interaction that satisfies it.
+type place struct {
+	meetingPlace *meeting.Place
+	tracer       oteltrace.Tracer
+}
+
+// NewRendezvous creates a new rendezvous point that will eventually
+// be completed with the result of a login, returning the id of the
+// rendezvous.
+func (p *place) NewRendezvous(ctx context.Context, waitID string) (string, error) {
+	id, err := p.meetingPlace.NewRendezvous(ctx, waitID, nil)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	return id, nil
+}
+
+// Done marks the rendezvous with the given id as complete, waking up
+// anyone waiting on it with the given login information.
+func (p *place) Done(ctx context.Context, id string, li *loginInfo) error {
+	ctx, span := p.tracer.Start(ctx, "place.Done", oteltrace.WithAttributes(dischargeIDAttribute.String(id)))
+	defer span.End()
+	if err := p.meetingPlace.Done(ctx, id, li); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// Wait waits for the rendezvous with the given id to complete and
+// returns the resulting login information.
+func (p *place) Wait(ctx context.Context, id string) (*loginInfo, error) {
+	_, data, err := p.meetingPlace.Wait(ctx, id)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	li, ok := data.(*loginInfo)
+	if !ok {
+		return nil, errgo.Newf("unexpected rendezvous data %T", data)
+	}
+	return li, nil
+}
@@ -0,0 +1,158 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
+	"gopkg.in/macaroon-bakery.v2/httpbakery"
+	macaroon "gopkg.in/macaroon.v2"
+
+	"github.com/CanonicalLtd/candid/internal/auth"
+)
+
+// amrDeclaredKey and authTimeDeclaredKey name the declared caveats
+// that record, in a discharge token, the authentication method used
+// (mirroring the OIDC "amr" claim) and the instant the user
+// authenticated. auth-time is added to every discharge token; amr is
+// added only when the name of the authenticating IDP is known.
+const (
+	amrDeclaredKey      = "amr"
+	authTimeDeclaredKey = "auth-time"
+)
+
+// formatAuthTime and parseAuthTime convert an authentication instant
+// to and from the form stored in a discharge token's declared
+// caveats.
+func formatAuthTime(t time.Time) string {
+	return strconv.FormatInt(t.Unix(), 10)
+}
+
+func parseAuthTime(s string) (time.Time, error) {
+	secs, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, errgo.Notef(err, "invalid auth-time")
+	}
+	return time.Unix(secs, 0), nil
+}
+
+// authContext describes what is known about how and when the holder
+// of a discharge token authenticated.
+type authContext struct {
+	// Method holds the name of the IDP used to authenticate, or ""
+	// if unknown.
+	Method string
+
+	// Time holds the instant the user authenticated, or the zero
+	// time if unknown.
+	Time time.Time
+}
+
+// authContextFromDischargeToken extracts the authContext recorded in
+// a discharge token's declared caveats.
+func authContextFromDischargeToken(dt *httpbakery.DischargeToken) authContext {
+	if dt == nil || dt.Kind != "macaroon" {
+		return authContext{}
+	}
+	var m macaroon.Macaroon
+	if err := m.UnmarshalBinary(dt.Value); err != nil {
+		return authContext{}
+	}
+	declared := checkers.InferDeclared(auth.Namespace, macaroon.Slice{&m})
+	ac := authContext{Method: declared[amrDeclaredKey]}
+	if s := declared[authTimeDeclaredKey]; s != "" {
+		if t, err := parseAuthTime(s); err == nil {
+			ac.Time = t
+		}
+	}
+	return ac
+}
+
+// requireAuthCondition is a parsed "require-auth" caveat condition,
+// as in "require-auth method=<name> max-age=<duration>". Either
+// field may be zero if not specified by the caller.
+type requireAuthCondition struct {
+	Method string
+	MaxAge time.Duration
+}
+
+// parseRequireAuthCondition parses a third-party caveat condition of
+// the form "require-auth method=<name> max-age=<duration>", returning
+// ok=false if condition is not a require-auth condition at all.
+func parseRequireAuthCondition(condition []byte) (requireAuthCondition, bool, error) {
+	fields := strings.Fields(string(condition))
+	if len(fields) == 0 || fields[0] != "require-auth" {
+		return requireAuthCondition{}, false, nil
+	}
+	var rc requireAuthCondition
+	for _, f := range fields[1:] {
+		k, v, ok := strings.Cut(f, "=")
+		if !ok {
+			return requireAuthCondition{}, false, errgo.Newf("invalid require-auth field %q", f)
+		}
+		switch k {
+		case "method":
+			rc.Method = v
+		case "max-age":
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return requireAuthCondition{}, false, errgo.Notef(err, "invalid max-age")
+			}
+			rc.MaxAge = d
+		default:
+			return requireAuthCondition{}, false, errgo.Newf("unknown require-auth field %q", k)
+		}
+	}
+	return rc, true, nil
+}
+
+// satisfiedBy reports whether ac satisfies the requirement described
+// by rc.
+func (rc requireAuthCondition) satisfiedBy(ac authContext) bool {
+	if rc.Method != "" && ac.Method != rc.Method {
+		return false
+	}
+	if rc.MaxAge != 0 {
+		if ac.Time.IsZero() || time.Since(ac.Time) > rc.MaxAge {
+			return false
+		}
+	}
+	return true
+}
+
+// caveat returns the first-party caveat that re-asserts this
+// requirement in the issued macaroon, so that downstream verifiers
+// enforce it again.
+func (rc requireAuthCondition) caveat() checkers.Caveat {
+	var b strings.Builder
+	b.WriteString("require-auth")
+	if rc.Method != "" {
+		b.WriteString(" method=")
+		b.WriteString(rc.Method)
+	}
+	if rc.MaxAge != 0 {
+		b.WriteString(" max-age=")
+		b.WriteString(rc.MaxAge.String())
+	}
+	return checkers.Caveat{Condition: b.String()}
+}
+
+// checkStepUp inspects p's caveat condition for a require-auth
+// requirement and reports whether the identity referred to by p.Token
+// already satisfies it. If there is no require-auth requirement it
+// reports satisfied=true so that callers fall through to their normal
+// behaviour.
+func checkStepUp(ctx context.Context, p httpbakery.ThirdPartyCaveatCheckerParams) (rc requireAuthCondition, present, satisfied bool, err error) {
+	rc, present, err = parseRequireAuthCondition(p.Caveat)
+	if err != nil || !present {
+		return rc, present, true, err
+	}
+	ac := authContextFromDischargeToken(p.Token)
+	return rc, true, rc.satisfiedBy(ac), nil
+}
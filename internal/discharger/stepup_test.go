@@ -0,0 +1,91 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRequireAuthCondition(t *testing.T) {
+	rc, ok, err := parseRequireAuthCondition([]byte("not-require-auth"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ok {
+		t.Fatalf("expected ok=false for a non-require-auth condition")
+	}
+
+	rc, ok, err = parseRequireAuthCondition([]byte("require-auth method=otp max-age=1h"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !ok {
+		t.Fatalf("expected ok=true")
+	}
+	if rc.Method != "otp" || rc.MaxAge != time.Hour {
+		t.Fatalf("unexpected parsed condition: %+v", rc)
+	}
+
+	if _, _, err := parseRequireAuthCondition([]byte("require-auth bogus")); err == nil {
+		t.Fatalf("expected an error for a malformed field")
+	}
+	if _, _, err := parseRequireAuthCondition([]byte("require-auth unknown=x")); err == nil {
+		t.Fatalf("expected an error for an unknown field")
+	}
+	if _, _, err := parseRequireAuthCondition([]byte("require-auth max-age=not-a-duration")); err == nil {
+		t.Fatalf("expected an error for an invalid max-age")
+	}
+}
+
+func TestRequireAuthConditionSatisfiedBy(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name string
+		rc   requireAuthCondition
+		ac   authContext
+		want bool
+	}{
+		{"no requirements", requireAuthCondition{}, authContext{}, true},
+		{"method matches", requireAuthCondition{Method: "otp"}, authContext{Method: "otp"}, true},
+		{"method mismatch", requireAuthCondition{Method: "otp"}, authContext{Method: "password"}, false},
+		{"recent enough", requireAuthCondition{MaxAge: time.Hour}, authContext{Time: now.Add(-time.Minute)}, true},
+		{"too old", requireAuthCondition{MaxAge: time.Hour}, authContext{Time: now.Add(-2 * time.Hour)}, false},
+		{"zero time with max-age", requireAuthCondition{MaxAge: time.Hour}, authContext{}, false},
+	}
+	for _, test := range tests {
+		if got := test.rc.satisfiedBy(test.ac); got != test.want {
+			t.Errorf("%s: satisfiedBy = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRequireAuthConditionCaveatRoundTrip(t *testing.T) {
+	rc := requireAuthCondition{Method: "otp", MaxAge: time.Hour}
+	cav := rc.caveat()
+	rc2, ok, err := parseRequireAuthCondition([]byte(cav.Condition))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !ok {
+		t.Fatalf("expected the re-parsed caveat to be a require-auth condition")
+	}
+	if rc2 != rc {
+		t.Fatalf("round trip mismatch: got %+v, want %+v", rc2, rc)
+	}
+}
+
+func TestFormatParseAuthTime(t *testing.T) {
+	now := time.Unix(time.Now().Unix(), 0)
+	got, err := parseAuthTime(formatAuthTime(now))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !got.Equal(now) {
+		t.Fatalf("round trip mismatch: got %v, want %v", got, now)
+	}
+	if _, err := parseAuthTime("not-a-number"); err == nil {
+		t.Fatalf("expected an error for an invalid auth-time")
+	}
+}
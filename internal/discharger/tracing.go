@@ -0,0 +1,46 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	oteltrace "go.opentelemetry.io/otel/trace"
+
+	"github.com/CanonicalLtd/candid/internal/identity"
+)
+
+// tracerName identifies this package as the source of the spans it
+// creates.
+const tracerName = "github.com/CanonicalLtd/candid/internal/discharger"
+
+// tracer returns the Tracer that should be used to start spans for
+// requests handled by params. If params.TracerProvider is nil the
+// global (by default no-op) TracerProvider is used, so that spans
+// can always be created safely.
+func tracer(params identity.HandlerParams) oteltrace.Tracer {
+	tp := params.TracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(tracerName)
+}
+
+// extractTraceContext returns a copy of ctx with the span context
+// extracted from any W3C traceparent/tracestate headers on req.
+func extractTraceContext(ctx context.Context, req *http.Request) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(req.Header))
+}
+
+// entityAttribute and friends name the span attributes that are
+// attached to the spans covering a discharge or IDP request.
+var (
+	entityAttribute      = attribute.Key("candid.entity")
+	idpAttribute         = attribute.Key("candid.idp")
+	dischargeIDAttribute = attribute.Key("candid.discharge_id")
+)
@@ -0,0 +1,29 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package discharger
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/CanonicalLtd/candid/internal/identity"
+)
+
+func TestTracerDefaultsToGlobalProvider(t *testing.T) {
+	tr := tracer(identity.HandlerParams{})
+	if tr == nil {
+		t.Fatalf("expected a non-nil tracer even with no TracerProvider configured")
+	}
+}
+
+func TestExtractTraceContextNoHeaders(t *testing.T) {
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatalf("cannot build request: %v", err)
+	}
+	ctx := extractTraceContext(req.Context(), req)
+	if ctx == nil {
+		t.Fatalf("expected a non-nil context")
+	}
+}
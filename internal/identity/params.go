@@ -0,0 +1,141 @@
+// Copyright 2014 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package identity
+
+import (
+	"context"
+	"crypto/ed25519"
+	"html/template"
+
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
+
+	"github.com/CanonicalLtd/candid/idp"
+	"github.com/CanonicalLtd/candid/internal/auth"
+	"github.com/CanonicalLtd/candid/meeting"
+	"github.com/CanonicalLtd/candid/store"
+)
+
+// HandlerParams are the parameters used when creating a new API
+// handler.
+type HandlerParams struct {
+	// Location holds the external location of the server, used to
+	// calculate URLs to send to clients.
+	Location string
+
+	// Store holds the store used by the API handlers.
+	Store store.Store
+
+	// MeetingStore holds the store used to hold rendezvous points
+	// for discharge requests.
+	MeetingStore meeting.Store
+
+	// MeetingPlace holds the meeting place used to co-ordinate
+	// browser logins with their initiating requests.
+	MeetingPlace *meeting.Place
+
+	// ProviderDataStore holds the store that identity providers
+	// can use to store provider specific data.
+	ProviderDataStore store.ProviderDataStore
+
+	// Oven holds the bakery.Oven that will be used to mint new
+	// macaroons.
+	Oven *bakery.Oven
+
+	// Authorizer holds the auth.Authorizer that will be used to
+	// authorize requests.
+	Authorizer *auth.Authorizer
+
+	// Key holds the key pair that is used by the server.
+	Key *bakery.KeyPair
+
+	// IdentityProviders holds the set of configured identity
+	// providers.
+	IdentityProviders []idp.IdentityProvider
+
+	// Template holds the set of templates used to render user
+	// facing pages, such as the login-complete page.
+	Template *template.Template
+
+	// DelegateChecker, if non-nil, is consulted by the third-party
+	// caveat checker before it attempts to discharge a caveat
+	// itself. It allows an operator to redirect part of the
+	// discharge flow to another discharger (for example to force
+	// step-up MFA or a group-membership check) by returning
+	// further caveats that the client must satisfy instead.
+	//
+	// If DelegateChecker is nil, or it returns no caveats, the
+	// checker carries on with its normal discharge behaviour.
+	DelegateChecker DelegateChecker
+
+	// RelyingPartyStore holds the set of OAuth2/OIDC relying
+	// parties that are allowed to use the OIDC provider endpoints.
+	// If it is nil, the OIDC endpoints are not registered.
+	RelyingPartyStore RelyingPartyStore
+
+	// OIDCSigningKey is the key used to sign the ID tokens issued
+	// by the OIDC provider endpoints. It is ignored if
+	// RelyingPartyStore is nil.
+	OIDCSigningKey ed25519.PrivateKey
+
+	// TracerProvider is used to create the spans that trace
+	// requests through the discharger's handler pipeline. If it
+	// is nil, the global OpenTelemetry TracerProvider is used,
+	// which defaults to a no-op implementation.
+	TracerProvider trace.TracerProvider
+}
+
+// A RelyingParty is an OAuth2/OIDC client that is registered to use
+// Candid's OIDC provider endpoints.
+type RelyingParty struct {
+	// ClientID is the identifier the relying party presents at the
+	// token endpoint.
+	ClientID string
+
+	// ClientSecretHash is a bcrypt hash of the relying party's
+	// client secret, or nil if the relying party authenticates
+	// with PKCE alone.
+	ClientSecretHash []byte
+
+	// RedirectURIs holds the redirect URIs that the relying party
+	// is allowed to use.
+	RedirectURIs []string
+
+	// Scopes holds the set of scopes that the relying party is
+	// allowed to request.
+	Scopes []string
+}
+
+// A RelyingPartyStore holds the set of relying parties registered to
+// use Candid's OIDC provider endpoints.
+type RelyingPartyStore interface {
+	// RelyingParty returns the relying party with the given client
+	// ID. It returns an error with a params.ErrNotFound cause if
+	// there is no such relying party.
+	RelyingParty(ctx context.Context, clientID string) (*RelyingParty, error)
+}
+
+// A DelegateChecker may intervene in the discharge of a third-party
+// caveat before Candid discharges it directly. Given the decoded
+// caveat condition and the identity that has already authenticated,
+// it may return a set of caveats - typically further third-party
+// caveats with their own Location and PublicKey - that the client
+// must satisfy instead of being issued an identity macaroon.
+//
+// A DelegateChecker that does not wish to intervene should return a
+// nil or empty slice of caveats and a nil error.
+//
+// CheckDelegate only runs once Candid already has a valid identity for
+// the request (the user has either presented a discharge token or
+// just completed an interactive login), so it never runs concurrently
+// with an in-progress browser rendezvous in the meeting place. A
+// delegate's returned caveats are resolved entirely by the client's
+// own DischargeAll call, with no further involvement from Candid; if
+// a delegate's discharge location itself requires an interactive
+// login, that location is responsible for its own rendezvous - Candid
+// does not thread the original discharge ID through to it.
+type DelegateChecker interface {
+	CheckDelegate(ctx context.Context, condition string, id *store.Identity) ([]checkers.Caveat, error)
+}